@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/docker/api/errdefs"
@@ -32,6 +35,22 @@ const (
 	// v1 scope like "https://management.azure.com/.default" for ARM access
 	scopes   = "offline_access https://management.azure.com/.default"
 	clientID = "04b07795-8ddb-461a-bbee-02f9e1bf7b46" // Azure CLI client id
+
+	// managementScope is the v1 scope requested for the client credentials grant. Client
+	// credentials tokens cannot be refreshed, so "offline_access" does not apply here.
+	managementScope = "https://management.azure.com/.default"
+
+	// servicePrincipalCredentialType is the only "type" value docker-distribution's Azure
+	// config accepts for the client secret flow.
+	servicePrincipalCredentialType = "client_secret"
+)
+
+// env vars consumed by NewAuthorizerFromLogin to pick a non-interactive service principal
+// login when no browser is available, e.g. in CI.
+const (
+	envServicePrincipalClientID     = "AZURE_CLIENT_ID"
+	envServicePrincipalClientSecret = "AZURE_CLIENT_SECRET"
+	envServicePrincipalTenantID     = "AZURE_TENANT_ID"
 )
 
 type (
@@ -51,12 +70,22 @@ type (
 	tenantValue struct {
 		TenantID string `json:"tenantId"`
 	}
+
+	// servicePrincipalCredentials mirrors the "client_secret" credentials block of the
+	// docker-distribution Azure config file.
+	servicePrincipalCredentials struct {
+		Type     string `json:"type"`
+		ClientID string `json:"clientid"`
+		TenantID string `json:"tenantid"`
+		Secret   string `json:"secret"`
+	}
 )
 
 // AzureLoginService Service to log into azure and get authentifier for azure APIs
 type AzureLoginService struct {
-	tokenStore tokenStore
-	apiHelper  apiHelper
+	tokenStore     tokenStore
+	tokenStorePath string
+	apiHelper      apiHelper
 }
 
 const tokenStoreFilename = "dockerAccessToken.json"
@@ -72,13 +101,51 @@ func newAzureLoginServiceFromPath(tokenStorePath string, helper apiHelper) (Azur
 		return AzureLoginService{}, err
 	}
 	return AzureLoginService{
-		tokenStore: store,
-		apiHelper:  helper,
+		tokenStore:     store,
+		tokenStorePath: tokenStorePath,
+		apiHelper:      helper,
 	}, nil
 }
 
+// LoginOption customizes a Login call.
+type LoginOption struct {
+	// TenantID pins the login to a specific tenant. If empty and the account has access to
+	// more than one tenant, Login fails with a MultipleTenantsError listing the choices.
+	TenantID string
+}
+
+// MultipleTenantsError is returned by Login when the account has access to more than one
+// tenant and no TenantID was specified, so that callers can prompt the user to pick one.
+type MultipleTenantsError struct {
+	Tenants []string
+}
+
+func (e MultipleTenantsError) Error() string {
+	return fmt.Sprintf("this account has access to multiple tenants, specify one of: %s", strings.Join(e.Tenants, ", "))
+}
+
+// selectTenantID picks the tenant to authenticate against: preferred if set, the lone
+// entry in tenants if there is exactly one, or a MultipleTenantsError listing the choices.
+// Shared by Login and LoginDeviceCode so neither one blindly picks tenants[0].
+func selectTenantID(tenants []tenantValue, preferred string) (string, error) {
+	if preferred != "" {
+		return preferred, nil
+	}
+	if len(tenants) == 0 {
+		return "", errors.New("this account has no tenants")
+	}
+	if len(tenants) > 1 {
+		ids := make([]string, len(tenants))
+		for i, t := range tenants {
+			ids[i] = t.TenantID
+		}
+		return "", MultipleTenantsError{Tenants: ids}
+	}
+	return tenants[0].TenantID, nil
+}
+
 //Login perform azure login through browser
-func (login AzureLoginService) Login(ctx context.Context) error {
+func (login AzureLoginService) Login(ctx context.Context, opts LoginOption) error {
 	queryCh := make(chan url.Values, 1)
 	serverPort, err := startLoginServer(queryCh)
 	if err != nil {
@@ -122,7 +189,10 @@ func (login AzureLoginService) Login(ctx context.Context) error {
 			if err := json.Unmarshal(bits, &tenantResult); err != nil {
 				return errors.Wrap(err, "login failed")
 			}
-			tenantID := tenantResult.Value[0].TenantID
+			tenantID, err := selectTenantID(tenantResult.Value, opts.TenantID)
+			if err != nil {
+				return err
+			}
 			tenantToken, err := login.refreshToken(token.RefreshToken, tenantID)
 			if err != nil {
 				return errors.Wrap(err, "login failed")
@@ -143,6 +213,125 @@ func (login AzureLoginService) Login(ctx context.Context) error {
 	}
 }
 
+// LoginServicePrincipal performs a non-interactive login using the client credentials
+// grant, for use in CI/automation where the browser-based Login flow cannot run. The
+// resulting access token has no refresh token: client credentials tokens cannot be
+// refreshed, so the client ID/secret/tenant are persisted alongside the token store and
+// GetValidToken re-runs this same grant on expiry instead of a refresh_token grant.
+func (login AzureLoginService) LoginServicePrincipal(ctx context.Context, clientID string, clientSecret string, tenantID string) error {
+	data := url.Values{
+		"grant_type":    []string{"client_credentials"},
+		"client_id":     []string{clientID},
+		"client_secret": []string{clientSecret},
+		"scope":         []string{managementScope},
+	}
+	token, err := login.apiHelper.queryToken(data, tenantID)
+	if err != nil {
+		return errors.Wrap(err, "access token request failed")
+	}
+	oauthToken := toOAuthToken(token)
+	// client credentials tokens are never issued a refresh token.
+	oauthToken.RefreshToken = ""
+
+	if err := login.tokenStore.writeLoginInfo(TokenInfo{TenantID: tenantID, Token: oauthToken}); err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	creds := servicePrincipalCredentials{
+		Type:     servicePrincipalCredentialType,
+		ClientID: clientID,
+		TenantID: tenantID,
+		Secret:   clientSecret,
+	}
+	if err := login.writeServicePrincipalCredentials(creds); err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+
+	return nil
+}
+
+// servicePrincipalCredentialsFilename is stored next to the token store so GetValidToken
+// can re-run the client credentials grant once the access token it protects has expired.
+const servicePrincipalCredentialsFilename = "dockerServicePrincipalCredentials.json"
+
+func (login AzureLoginService) servicePrincipalCredentialsPath() string {
+	return filepath.Join(filepath.Dir(login.tokenStorePath), servicePrincipalCredentialsFilename)
+}
+
+func (login AzureLoginService) writeServicePrincipalCredentials(creds servicePrincipalCredentials) error {
+	bits, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(login.servicePrincipalCredentialsPath(), bits, 0600)
+}
+
+func (login AzureLoginService) readServicePrincipalCredentials() (servicePrincipalCredentials, error) {
+	bits, err := ioutil.ReadFile(login.servicePrincipalCredentialsPath())
+	if err != nil {
+		return servicePrincipalCredentials{}, err
+	}
+	var creds servicePrincipalCredentials
+	if err := json.Unmarshal(bits, &creds); err != nil {
+		return servicePrincipalCredentials{}, err
+	}
+	return creds, nil
+}
+
+// renewServicePrincipalToken re-authenticates with the service principal credentials
+// persisted by LoginServicePrincipal, since a client credentials token has no refresh
+// token to fall back to.
+func (login AzureLoginService) renewServicePrincipalToken() (oauth2.Token, error) {
+	creds, err := login.readServicePrincipalCredentials()
+	if err != nil {
+		return oauth2.Token{}, errors.Wrap(err, "access token request failed. Maybe you need to login to azure again.")
+	}
+	if err := login.LoginServicePrincipal(context.Background(), creds.ClientID, creds.Secret, creds.TenantID); err != nil {
+		return oauth2.Token{}, err
+	}
+	loginInfo, err := login.tokenStore.readToken()
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+	return loginInfo.Token, nil
+}
+
+// renewNonRefreshableToken re-authenticates a token that was issued without a refresh
+// token. Both LoginServicePrincipal and LoginManagedIdentity produce such tokens, so this
+// tries each source's persisted credentials in turn rather than assuming the token came
+// from one or the other, and only reports a generic re-login error once neither is found.
+func (login AzureLoginService) renewNonRefreshableToken() (oauth2.Token, error) {
+	if _, err := os.Stat(login.servicePrincipalCredentialsPath()); err == nil {
+		return login.renewServicePrincipalToken()
+	}
+	if creds, err := login.readManagedIdentityCredentials(); err == nil {
+		return login.renewManagedIdentityToken(creds)
+	}
+	return oauth2.Token{}, errors.New("access token request failed. Maybe you need to login to azure again.")
+}
+
+// LoginServicePrincipalFromCredentialsFile reads a docker-distribution style Azure
+// credentials file (type/clientid/tenantid/secret) and logs in with LoginServicePrincipal.
+func (login AzureLoginService) LoginServicePrincipalFromCredentialsFile(ctx context.Context, credentialsPath string) error {
+	bits, err := ioutil.ReadFile(credentialsPath)
+	if err != nil {
+		return errors.Wrap(err, "could not read azure credentials file")
+	}
+	var creds servicePrincipalCredentials
+	if err := json.Unmarshal(bits, &creds); err != nil {
+		return errors.Wrap(err, "could not parse azure credentials file")
+	}
+	if creds.Type != servicePrincipalCredentialType {
+		return fmt.Errorf("unsupported azure credentials type %q, expected %q", creds.Type, servicePrincipalCredentialType)
+	}
+
+	if err := login.LoginServicePrincipal(ctx, creds.ClientID, creds.Secret, creds.TenantID); err != nil {
+		return err
+	}
+	fmt.Println("Login Succeeded")
+
+	return nil
+}
+
 func getTokenStorePath() string {
 	cliPath, _ := cli.AccessTokensPath()
 	return filepath.Join(filepath.Dir(cliPath), tokenStoreFilename)
@@ -165,11 +354,39 @@ func NewAuthorizerFromLogin() (autorest.Authorizer, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	spClientID, hasClientID := os.LookupEnv(envServicePrincipalClientID)
+	spClientSecret, hasClientSecret := os.LookupEnv(envServicePrincipalClientSecret)
+	spTenantID, hasTenantID := os.LookupEnv(envServicePrincipalTenantID)
+	if hasClientID && hasClientSecret && hasTenantID {
+		if err := login.LoginServicePrincipal(context.Background(), spClientID, spClientSecret, spTenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(getTokenStorePath()); os.IsNotExist(err) {
+		// Try the az CLI first: it is a cheap, local check (PATH lookup + `az version`).
+		// Only fall through to an IMDS probe, which blocks on a network dial, once that
+		// cheaper source has been ruled out.
+		if authorizer, err := newAuthorizerFromAzureCLIIfAvailable(); err == nil {
+			return authorizer, nil
+		}
+		if managedIdentityRequested() || probeIMDS() {
+			if err := login.LoginManagedIdentity(context.Background(), "", ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	oauthToken, err := login.GetValidToken()
 	if err != nil {
 		return nil, err
 	}
 
+	return authorizerFromOAuthToken(oauthToken), nil
+}
+
+func authorizerFromOAuthToken(oauthToken oauth2.Token) autorest.Authorizer {
 	token := adal.Token{
 		AccessToken:  oauthToken.AccessToken,
 		Type:         oauthToken.TokenType,
@@ -179,7 +396,37 @@ func NewAuthorizerFromLogin() (autorest.Authorizer, error) {
 		Resource:     "",
 	}
 
-	return autorest.NewBearerAuthorizer(&token), nil
+	return autorest.NewBearerAuthorizer(&token)
+}
+
+// Logout deletes the stored access token and any persisted renewal credentials, so a
+// subsequent Login starts from a clean slate, e.g. to switch accounts or recover from a
+// stuck/revoked token. This also ensures a service principal's plaintext secret does not
+// outlive the login it was kept for.
+func (login AzureLoginService) Logout(ctx context.Context) error {
+	if err := os.Remove(login.tokenStorePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not log out")
+	}
+	if err := os.Remove(login.servicePrincipalCredentialsPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not log out")
+	}
+	if err := os.Remove(login.managedIdentityCredentialsPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not log out")
+	}
+	return nil
+}
+
+// ExpireToken marks the cached token as expired without deleting it, forcing the next
+// GetValidToken to renew it: through refreshToken, or, for a token issued without a
+// refresh token, by re-running renewNonRefreshableToken.
+func (login AzureLoginService) ExpireToken() error {
+	loginInfo, err := login.tokenStore.readToken()
+	if err != nil {
+		return err
+	}
+	loginInfo.Token.Expiry = time.Now().Add(-time.Minute)
+
+	return login.tokenStore.writeLoginInfo(loginInfo)
 }
 
 // GetValidToken returns an access token. Refresh token if needed
@@ -192,6 +439,9 @@ func (login AzureLoginService) GetValidToken() (oauth2.Token, error) {
 	if token.Valid() {
 		return token, nil
 	}
+	if token.RefreshToken == "" {
+		return login.renewNonRefreshableToken()
+	}
 	tenantID := loginInfo.TenantID
 	token, err = login.refreshToken(token.RefreshToken, tenantID)
 	if err != nil {
@@ -204,6 +454,51 @@ func (login AzureLoginService) GetValidToken() (oauth2.Token, error) {
 	return token, nil
 }
 
+// ListTenants returns the IDs of the tenants the currently logged in account has access to.
+func (login AzureLoginService) ListTenants(ctx context.Context) ([]string, error) {
+	token, err := login.GetValidToken()
+	if err != nil {
+		return nil, err
+	}
+
+	bits, statusCode, err := login.apiHelper.queryAuthorizationAPI(authorizationURL, fmt.Sprintf("Bearer %s", token.AccessToken))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list tenants")
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("could not list tenants: %s", string(bits))
+	}
+
+	var tenantResult tenantResult
+	if err := json.Unmarshal(bits, &tenantResult); err != nil {
+		return nil, errors.Wrap(err, "could not list tenants")
+	}
+
+	tenants := make([]string, len(tenantResult.Value))
+	for i, t := range tenantResult.Value {
+		tenants[i] = t.TenantID
+	}
+
+	return tenants, nil
+}
+
+// SetCurrentTenant switches the stored token to a different tenant, refreshing against it
+// with the existing refresh token. Subsequent GetValidToken calls will refresh against this
+// tenant rather than re-resolving it.
+func (login AzureLoginService) SetCurrentTenant(ctx context.Context, tenantID string) error {
+	loginInfo, err := login.tokenStore.readToken()
+	if err != nil {
+		return err
+	}
+
+	token, err := login.refreshToken(loginInfo.Token.RefreshToken, tenantID)
+	if err != nil {
+		return errors.Wrap(err, "could not switch tenant")
+	}
+
+	return login.tokenStore.writeLoginInfo(TokenInfo{TenantID: tenantID, Token: token})
+}
+
 func (login AzureLoginService) refreshToken(currentRefreshToken string, tenantID string) (oauth2.Token, error) {
 	data := url.Values{
 		"grant_type":    []string{"refresh_token"},
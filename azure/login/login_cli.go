@@ -0,0 +1,123 @@
+package login
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// minimumAzCLIVersion is the oldest az CLI release known to support
+// `account get-access-token --resource`.
+const minimumAzCLIVersion = "2.0.61"
+
+// azCLIExpiresOnLayout is the local-time layout `az account get-access-token` reports
+// "expiresOn" in, e.g. "2021-06-15 12:30:45.000000".
+const azCLIExpiresOnLayout = "2006-01-02 15:04:05.000000"
+
+// azCLIAccessToken is the subset of `az account get-access-token -o json` this package cares about.
+type azCLIAccessToken struct {
+	AccessToken  string `json:"accessToken"`
+	ExpiresOn    string `json:"expiresOn"`
+	Tenant       string `json:"tenant"`
+	Subscription string `json:"subscription"`
+}
+
+// azCLIVersion is the subset of `az version -o json` this package cares about.
+type azCLIVersion struct {
+	AzureCli string `json:"azure-cli"`
+}
+
+// NewAuthorizerFromAzureCLI creates an authorizer from a token obtained by delegating to
+// an already signed-in az CLI, so that users who ran `az login` don't have to go through
+// the browser flow a second time.
+func NewAuthorizerFromAzureCLI() (autorest.Authorizer, error) {
+	if err := checkAzCLIAvailable(); err != nil {
+		return nil, err
+	}
+	token, err := getAzureCLIToken("")
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := time.ParseInLocation(azCLIExpiresOnLayout, token.ExpiresOn, time.Local)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse az CLI token expiry")
+	}
+	fmt.Printf("Using az CLI token for subscription %s (tenant %s)\n", token.Subscription, token.Tenant)
+
+	return authorizerFromOAuthToken(oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}), nil
+}
+
+// newAuthorizerFromAzureCLIIfAvailable is the best-effort fallback used by
+// NewAuthorizerFromLogin when no dockerAccessToken.json exists yet.
+func newAuthorizerFromAzureCLIIfAvailable() (autorest.Authorizer, error) {
+	return NewAuthorizerFromAzureCLI()
+}
+
+func checkAzCLIAvailable() error {
+	path, err := exec.LookPath("az")
+	if err != nil {
+		return errors.New("az CLI not found on PATH")
+	}
+
+	out, err := exec.Command(path, "version", "-o", "json").Output()
+	if err != nil {
+		return errors.Wrap(err, "could not determine az CLI version")
+	}
+	var versions azCLIVersion
+	if err := json.Unmarshal(out, &versions); err != nil {
+		return errors.Wrap(err, "could not parse az CLI version")
+	}
+	if versions.AzureCli != "" && compareVersions(versions.AzureCli, minimumAzCLIVersion) < 0 {
+		return errors.Errorf("az CLI %s is too old, need at least %s", versions.AzureCli, minimumAzCLIVersion)
+	}
+
+	return nil
+}
+
+func getAzureCLIToken(tenantID string) (azCLIAccessToken, error) {
+	args := []string{"account", "get-access-token", "--resource", "https://management.azure.com", "-o", "json"}
+	if tenantID != "" {
+		args = append(args, "--tenant", tenantID)
+	}
+
+	out, err := exec.Command("az", args...).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "az login") {
+			return azCLIAccessToken{}, errors.New("az CLI is not logged in, run `az login` first")
+		}
+		return azCLIAccessToken{}, errors.Wrap(err, "az account get-access-token failed")
+	}
+
+	var token azCLIAccessToken
+	if err := json.Unmarshal(out, &token); err != nil {
+		return azCLIAccessToken{}, errors.Wrap(err, "could not parse az account get-access-token output")
+	}
+
+	return token, nil
+}
+
+// compareVersions compares two dotted numeric version strings, returning <0, 0, >0
+// depending on whether a is older than, equal to, or newer than b.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, _ := strconv.Atoi(as[i])
+		bn, _ := strconv.Atoi(bs[i])
+		if an != bn {
+			return an - bn
+		}
+	}
+	return len(as) - len(bs)
+}
@@ -0,0 +1,163 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const deviceCodeEndpoint = "https://login.microsoftonline.com/organizations/oauth2/v2.0/devicecode"
+
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+type deviceTokenResponse struct {
+	azureToken
+	Error string `json:"error"`
+}
+
+// LoginDeviceCode implements the OAuth 2.0 device authorization grant (RFC 8628), for use
+// on remote shells, containers, and CI runners where Login's browser + localhost server
+// approach doesn't work.
+func (login AzureLoginService) LoginDeviceCode(ctx context.Context) error {
+	deviceCode, err := requestDeviceCode()
+	if err != nil {
+		return errors.Wrap(err, "device code request failed")
+	}
+
+	fmt.Printf("To sign in, open %s and enter the code %s to authenticate.\n", deviceCode.VerificationURI, deviceCode.UserCode)
+	if deviceCode.Message != "" {
+		fmt.Println(deviceCode.Message)
+	}
+
+	token, err := pollDeviceCodeToken(ctx, deviceCode)
+	if err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+
+	bits, statusCode, err := login.apiHelper.queryAuthorizationAPI(authorizationURL, fmt.Sprintf("Bearer %s", token.AccessToken))
+	if err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	if statusCode != 200 {
+		return fmt.Errorf("login failed : " + string(bits))
+	}
+
+	var tenantResult tenantResult
+	if err := json.Unmarshal(bits, &tenantResult); err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	tenantID, err := selectTenantID(tenantResult.Value, "")
+	if err != nil {
+		return err
+	}
+	tenantToken, err := login.refreshToken(token.RefreshToken, tenantID)
+	if err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+
+	if err := login.tokenStore.writeLoginInfo(TokenInfo{TenantID: tenantID, Token: tenantToken}); err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	fmt.Println("Login Succeeded")
+
+	return nil
+}
+
+func requestDeviceCode() (deviceCodeResponse, error) {
+	data := url.Values{
+		"client_id": []string{clientID},
+		"scope":     []string{scopes},
+	}
+	resp, err := http.PostForm(deviceCodeEndpoint, data)
+	if err != nil {
+		return deviceCodeResponse{}, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return deviceCodeResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return deviceCodeResponse{}, fmt.Errorf("%s", string(bits))
+	}
+
+	var deviceCode deviceCodeResponse
+	if err := json.Unmarshal(bits, &deviceCode); err != nil {
+		return deviceCodeResponse{}, err
+	}
+
+	return deviceCode, nil
+}
+
+// pollDeviceCodeToken polls the token endpoint until the user has authenticated, the device
+// code expires, or ctx is cancelled, per RFC 8628.
+func pollDeviceCodeToken(ctx context.Context, deviceCode deviceCodeResponse) (azureToken, error) {
+	interval := time.Duration(deviceCode.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(deviceCode.ExpiresIn) * time.Second)
+
+	data := url.Values{
+		"grant_type":  []string{"urn:ietf:params:oauth:grant-type:device_code"},
+		"client_id":   []string{clientID},
+		"device_code": []string{deviceCode.DeviceCode},
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return azureToken{}, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		if time.Now().After(deadline) {
+			return azureToken{}, errors.New("device code expired")
+		}
+
+		resp, err := http.PostForm(fmt.Sprintf(tokenEndpoint, "organizations"), data)
+		if err != nil {
+			return azureToken{}, err
+		}
+		bits, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close() // nolint:errcheck
+		if err != nil {
+			return azureToken{}, err
+		}
+
+		var token deviceTokenResponse
+		if err := json.Unmarshal(bits, &token); err != nil {
+			return azureToken{}, err
+		}
+
+		switch token.Error {
+		case "":
+			return token.azureToken, nil
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+		case "expired_token":
+			return azureToken{}, errors.New("device code expired")
+		case "authorization_declined":
+			return azureToken{}, errors.New("authorization declined")
+		default:
+			return azureToken{}, fmt.Errorf("device code login failed: %s", strings.TrimSpace(token.Error))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// envUseManagedIdentity, when set to "1", tells NewAuthorizerFromLogin to use the Instance
+// Metadata Service without probing it first. This applies only when no token store exists
+// and the az CLI fallback has failed.
+const envUseManagedIdentity = "AZURE_USE_MSI"
+
+const (
+	imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	imdsAPIVersion    = "2018-02-01"
+	imdsProbeTimeout  = 500 * time.Millisecond
+)
+
+// imdsTokenResponse is the subset of the IMDS oauth2/token response this package cares about.
+type imdsTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   string `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// managedIdentityCredentials records which identity LoginManagedIdentity authenticated
+// with, persisted alongside the token store so GetValidToken can re-query IMDS on expiry
+// instead of mistaking this for a service principal token.
+type managedIdentityCredentials struct {
+	ClientID   string `json:"clientid"`
+	ResourceID string `json:"resourceid"`
+}
+
+// managedIdentityCredentialsFilename is stored next to the token store so GetValidToken
+// can tell an IMDS-issued token apart from a service principal one, both of which carry
+// an empty refresh token.
+const managedIdentityCredentialsFilename = "dockerManagedIdentityCredentials.json"
+
+func (login AzureLoginService) managedIdentityCredentialsPath() string {
+	return filepath.Join(filepath.Dir(login.tokenStorePath), managedIdentityCredentialsFilename)
+}
+
+func (login AzureLoginService) writeManagedIdentityCredentials(creds managedIdentityCredentials) error {
+	bits, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(login.managedIdentityCredentialsPath(), bits, 0600)
+}
+
+func (login AzureLoginService) readManagedIdentityCredentials() (managedIdentityCredentials, error) {
+	bits, err := ioutil.ReadFile(login.managedIdentityCredentialsPath())
+	if err != nil {
+		return managedIdentityCredentials{}, err
+	}
+	var creds managedIdentityCredentials
+	if err := json.Unmarshal(bits, &creds); err != nil {
+		return managedIdentityCredentials{}, err
+	}
+	return creds, nil
+}
+
+// renewManagedIdentityToken re-queries IMDS for the identity LoginManagedIdentity last
+// authenticated with, since an IMDS-issued token has no refresh token to fall back to.
+func (login AzureLoginService) renewManagedIdentityToken(creds managedIdentityCredentials) (oauth2.Token, error) {
+	if err := login.LoginManagedIdentity(context.Background(), creds.ClientID, creds.ResourceID); err != nil {
+		return oauth2.Token{}, err
+	}
+	loginInfo, err := login.tokenStore.readToken()
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+	return loginInfo.Token, nil
+}
+
+// managedIdentityTokenSource obtains tokens from the Azure Instance Metadata Service,
+// optionally selecting a user-assigned identity.
+type managedIdentityTokenSource struct {
+	clientID   string
+	resourceID string
+}
+
+func newManagedIdentityTokenSource(clientID string, resourceID string) managedIdentityTokenSource {
+	return managedIdentityTokenSource{
+		clientID:   clientID,
+		resourceID: resourceID,
+	}
+}
+
+func (m managedIdentityTokenSource) token() (azureToken, error) {
+	query := url.Values{
+		"api-version": []string{imdsAPIVersion},
+		"resource":    []string{"https://management.azure.com/"},
+	}
+	if m.clientID != "" {
+		query.Set("client_id", m.clientID)
+	}
+	if m.resourceID != "" {
+		query.Set("mi_res_id", m.resourceID)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, imdsTokenEndpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return azureToken{}, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return azureToken{}, errors.Wrap(err, "managed identity token request failed")
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	bits, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return azureToken{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return azureToken{}, errors.Errorf("managed identity token request failed: %s", string(bits))
+	}
+
+	var imdsToken imdsTokenResponse
+	if err := json.Unmarshal(bits, &imdsToken); err != nil {
+		return azureToken{}, errors.Wrap(err, "could not parse managed identity token response")
+	}
+
+	var expiresIn int
+	if imdsToken.ExpiresIn != "" {
+		if _, err := fmt.Sscan(imdsToken.ExpiresIn, &expiresIn); err != nil {
+			return azureToken{}, errors.Wrap(err, "could not parse managed identity token expiry")
+		}
+	}
+
+	return azureToken{
+		Type:        imdsToken.TokenType,
+		AccessToken: imdsToken.AccessToken,
+		ExpiresIn:   expiresIn,
+	}, nil
+}
+
+// probeIMDS reports whether the Instance Metadata Service answers within a short timeout,
+// used to auto-detect that we are running inside Azure.
+func probeIMDS() bool {
+	client := &http.Client{Timeout: imdsProbeTimeout}
+	req, err := http.NewRequest(http.MethodGet, imdsTokenEndpoint+"?api-version="+imdsAPIVersion+"&resource=https://management.azure.com/", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	return true
+}
+
+// LoginManagedIdentity authenticates via the Instance Metadata Service, for use inside
+// Azure VMs/AKS where no interactive login is possible. clientID and resourceID select a
+// user-assigned identity and are mutually exclusive; leave both empty for the system-assigned
+// identity.
+func (login AzureLoginService) LoginManagedIdentity(ctx context.Context, clientID string, resourceID string) error {
+	token, err := newManagedIdentityTokenSource(clientID, resourceID).token()
+	if err != nil {
+		return errors.Wrap(err, "managed identity login failed")
+	}
+
+	if err := login.tokenStore.writeLoginInfo(TokenInfo{Token: toOAuthToken(token)}); err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	creds := managedIdentityCredentials{ClientID: clientID, ResourceID: resourceID}
+	if err := login.writeManagedIdentityCredentials(creds); err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	// renewNonRefreshableToken checks for service principal credentials first, so drop any
+	// left over from an earlier LoginServicePrincipal whose token has just been replaced.
+	if err := os.Remove(login.servicePrincipalCredentialsPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "login failed")
+	}
+
+	return nil
+}
+
+func managedIdentityRequested() bool {
+	return os.Getenv(envUseManagedIdentity) == "1"
+}